@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ActivityMonitoredConn wraps a net.Conn, tracking the time of the last read
+// and write and the total bytes transferred in each direction. It's used to
+// drive idle-triggered SSH keepalives and to report per-tunnel activity
+// statistics, without requiring any change to the underlying conn's callers.
+type ActivityMonitoredConn struct {
+	net.Conn
+	lastReadTime      int64 // unix nanoseconds; accessed via sync/atomic
+	lastWriteTime     int64 // unix nanoseconds; accessed via sync/atomic
+	totalBytesRead    int64
+	totalBytesWritten int64
+}
+
+// NewActivityMonitoredConn creates an ActivityMonitoredConn wrapping conn.
+func NewActivityMonitoredConn(conn net.Conn) *ActivityMonitoredConn {
+	now := time.Now().UnixNano()
+	return &ActivityMonitoredConn{
+		Conn:          conn,
+		lastReadTime:  now,
+		lastWriteTime: now,
+	}
+}
+
+func (conn *ActivityMonitoredConn) Read(buffer []byte) (int, error) {
+	n, err := conn.Conn.Read(buffer)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastReadTime, time.Now().UnixNano())
+		atomic.AddInt64(&conn.totalBytesRead, int64(n))
+	}
+	return n, err
+}
+
+func (conn *ActivityMonitoredConn) Write(buffer []byte) (int, error) {
+	n, err := conn.Conn.Write(buffer)
+	if n > 0 {
+		atomic.StoreInt64(&conn.lastWriteTime, time.Now().UnixNano())
+		atomic.AddInt64(&conn.totalBytesWritten, int64(n))
+	}
+	return n, err
+}
+
+// LastActiveTime is the more recent of the last read and last write times.
+func (conn *ActivityMonitoredConn) LastActiveTime() time.Time {
+	lastReadTime := atomic.LoadInt64(&conn.lastReadTime)
+	lastWriteTime := atomic.LoadInt64(&conn.lastWriteTime)
+	if lastWriteTime > lastReadTime {
+		return time.Unix(0, lastWriteTime)
+	}
+	return time.Unix(0, lastReadTime)
+}
+
+// LastReadTime returns the time of the most recent read from the conn.
+func (conn *ActivityMonitoredConn) LastReadTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastReadTime))
+}
+
+// LastWriteTime returns the time of the most recent write to the conn.
+func (conn *ActivityMonitoredConn) LastWriteTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&conn.lastWriteTime))
+}
+
+// BytesRead returns the total number of bytes read from the conn so far.
+func (conn *ActivityMonitoredConn) BytesRead() int64 {
+	return atomic.LoadInt64(&conn.totalBytesRead)
+}
+
+// BytesWritten returns the total number of bytes written to the conn so far.
+func (conn *ActivityMonitoredConn) BytesWritten() int64 {
+	return atomic.LoadInt64(&conn.totalBytesWritten)
+}
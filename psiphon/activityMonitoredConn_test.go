@@ -0,0 +1,93 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestActivityMonitoredConnTracksBytesReadAndWritten(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := NewActivityMonitoredConn(client)
+
+	go server.Write([]byte("hello"))
+	buffer := make([]byte, 5)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if int64(n) != conn.BytesRead() {
+		t.Errorf("BytesRead() = %d, expected %d", conn.BytesRead(), n)
+	}
+
+	readDone := make(chan []byte, 1)
+	go func() {
+		buffer := make([]byte, 3)
+		server.Read(buffer)
+		readDone <- buffer
+	}()
+	n, err = conn.Write([]byte("bye"))
+	if err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	<-readDone
+	if int64(n) != conn.BytesWritten() {
+		t.Errorf("BytesWritten() = %d, expected %d", conn.BytesWritten(), n)
+	}
+}
+
+func TestActivityMonitoredConnLastActiveTimeIsMostRecent(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	conn := NewActivityMonitoredConn(client)
+
+	go server.Write([]byte("x"))
+	buffer := make([]byte, 1)
+	if _, err := conn.Read(buffer); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	afterRead := conn.LastActiveTime()
+
+	time.Sleep(10 * time.Millisecond)
+
+	readDone := make(chan struct{})
+	go func() {
+		server.Read(make([]byte, 1))
+		close(readDone)
+	}()
+	if _, err := conn.Write([]byte("y")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	<-readDone
+
+	if !conn.LastActiveTime().After(afterRead) {
+		t.Errorf("expected LastActiveTime() to advance past the read-only timestamp after a later write")
+	}
+	if !conn.LastWriteTime().After(conn.LastReadTime()) {
+		t.Errorf("expected LastWriteTime() to be after LastReadTime() following the later write")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"time"
+)
+
+// DialStats records how a tunnel's transport and SSH session were
+// established, for correlation with server-observed session logs and for
+// surfacing connection quality in the controller/UI.
+type DialStats struct {
+	Protocol                string
+	MeekFrontingHost        string
+	TLSProfile              string
+	ConnectElapsedTime      time.Duration
+	ObfuscationElapsedTime  time.Duration
+	SshHandshakeElapsedTime time.Duration
+	TotalElapsedTime        time.Duration
+	BytesUp                 int64
+	BytesDown               int64
+}
+
+// ActivityStats is a point-in-time snapshot of a tunnel's traffic activity.
+type ActivityStats struct {
+	LastReadTime  time.Time
+	LastWriteTime time.Time
+	BytesRead     int64
+	BytesWritten  int64
+}
+
+// DialResult is the outcome of dialing a server's transport and layering
+// obfuscation on top of it, in preparation for the SSH handshake. It's
+// consumed by EstablishTunnel to complete the SSH session and build the
+// Tunnel, and its Stats are retained for Tunnel.GetDialStats().
+type DialResult struct {
+	Conn    Conn
+	SshConn *ActivityMonitoredConn
+	Stats   *DialStats
+}
+
+// GetDialStats returns the statistics recorded while this tunnel's
+// transport and SSH session were established.
+func (tunnel *Tunnel) GetDialStats() *DialStats {
+	return tunnel.dialStats
+}
+
+// GetActivityStats returns a snapshot of this tunnel's current traffic
+// activity.
+func (tunnel *Tunnel) GetActivityStats() *ActivityStats {
+	return &ActivityStats{
+		LastReadTime:  tunnel.activityConn.LastReadTime(),
+		LastWriteTime: tunnel.activityConn.LastWriteTime(),
+		BytesRead:     tunnel.activityConn.BytesRead(),
+		BytesWritten:  tunnel.activityConn.BytesWritten(),
+	}
+}
+
+var _ net.Conn = (*ActivityMonitoredConn)(nil)
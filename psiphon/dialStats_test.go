@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"net"
+	"testing"
+)
+
+func TestTunnelGetDialStatsReturnsRecordedStats(t *testing.T) {
+	stats := &DialStats{Protocol: "OSSH", BytesUp: 10, BytesDown: 20}
+	tunnel := &Tunnel{dialStats: stats}
+
+	if tunnel.GetDialStats() != stats {
+		t.Errorf("GetDialStats() did not return the recorded stats")
+	}
+}
+
+func TestTunnelGetActivityStatsReflectsActivityConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	activityConn := NewActivityMonitoredConn(client)
+	tunnel := &Tunnel{activityConn: activityConn}
+
+	go server.Write([]byte("payload"))
+	buffer := make([]byte, 7)
+	if _, err := activityConn.Read(buffer); err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+
+	activityStats := tunnel.GetActivityStats()
+	if activityStats.BytesRead != activityConn.BytesRead() {
+		t.Errorf("BytesRead = %d, expected %d", activityStats.BytesRead, activityConn.BytesRead())
+	}
+	if activityStats.LastReadTime != activityConn.LastReadTime() {
+		t.Errorf("LastReadTime = %v, expected %v", activityStats.LastReadTime, activityConn.LastReadTime())
+	}
+}
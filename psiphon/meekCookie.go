@@ -0,0 +1,212 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+// obfuscateMeekCookieSeedLength is the size, in bytes, of the per-cookie
+// random seed prepended, in cleartext, to an obfuscated meek cookie.
+const obfuscateMeekCookieSeedLength = 16
+
+// obfuscateMeekCookieKeyRounds is the number of SHA-1 rounds applied when
+// deriving an RC4 key from a seed and the server entry's SshObfuscatedKey,
+// matching the obfuscated SSH layer's seed-to-keystream derivation.
+const obfuscateMeekCookieKeyRounds = 6000
+
+// MEEK_PROTOCOL_VERSION is carried in the meek cookie payload so that future,
+// incompatible changes to the cookie format can be negotiated between client
+// and server.
+const MEEK_PROTOCOL_VERSION = 1
+
+// MEEK_COOKIE_NAME is the HTTP cookie name DialMeek attaches the value
+// returned by makeMeekCookie to, and that a meek server reads to identify
+// the session carried by a request.
+const MEEK_COOKIE_NAME = "P"
+
+// meekCookieData is the plaintext payload encrypted into a meek cookie.
+type meekCookieData struct {
+	ServerAddress       string `json:"ServerAddress"`
+	SessionId           string `json:"SessionId"`
+	MeekProtocolVersion int    `json:"MeekProtocolVersion"`
+}
+
+// makeMeekCookie constructs the value of the HTTP cookie sent with each meek
+// request, identifying the session to the meek server.
+//
+// The cookie payload -- server address, session ID, and meek protocol
+// version -- is JSON encoded and then encrypted, NaCl box style, using the
+// meek server's curve25519 public key and a fresh, ephemeral client key
+// pair. A fixed, all-zero nonce is safe here because a new ephemeral key
+// pair is generated for every cookie. The ephemeral public key is prepended
+// to the box so the server can complete the key agreement.
+//
+// For unfronted meek, where there's no fronting CDN's TLS to hide the
+// connection from an on-path observer, the encrypted cookie is additionally
+// obfuscated with a fresh, per-cookie random seed mixed into the
+// obfuscated SSH layer's seed-to-keystream derivation, keyed with the
+// server entry's SshObfuscatedKey, so the same cookie bytes never produce
+// the same keystream twice and an observer gains no fingerprint across
+// sessions to a given server.
+func makeMeekCookie(serverEntry *ServerEntry, sessionId string, useFronting bool) (string, error) {
+
+	ephemeralPublicKey, ephemeralPrivateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	decodedServerPublicKey, err := base64.StdEncoding.DecodeString(serverEntry.MeekCookieEncryptionPublicKey)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	if len(decodedServerPublicKey) != 32 {
+		return "", ContextError(errors.New("invalid meek cookie encryption public key"))
+	}
+	var meekServerPublicKey [32]byte
+	copy(meekServerPublicKey[:], decodedServerPublicKey)
+
+	payload, err := json.Marshal(
+		meekCookieData{
+			ServerAddress:       serverEntry.IpAddress,
+			SessionId:           sessionId,
+			MeekProtocolVersion: MEEK_PROTOCOL_VERSION,
+		})
+	if err != nil {
+		return "", ContextError(err)
+	}
+
+	var nonce [24]byte
+	sealedBox := box.Seal(nil, payload, &nonce, &meekServerPublicKey, ephemeralPrivateKey)
+
+	cookieData := append(ephemeralPublicKey[:], sealedBox...)
+
+	if !useFronting {
+		cookieData, err = obfuscateMeekCookie(serverEntry.SshObfuscatedKey, cookieData)
+		if err != nil {
+			return "", ContextError(err)
+		}
+	}
+
+	return base64.StdEncoding.EncodeToString(cookieData), nil
+}
+
+// UnpackMeekCookie reverses makeMeekCookie, given the meek server's
+// curve25519 private key and, for unfronted meek, the same obfuscationKey
+// the client used. It's the server-side counterpart used by a TunnelServer
+// to recover the session ID and dialed server address carried by a meek
+// request's cookie.
+func UnpackMeekCookie(
+	serverPrivateKey *[32]byte, obfuscationKey string, useFronting bool, cookieValue string) (serverAddress, sessionId string, err error) {
+
+	cookieData, err := base64.StdEncoding.DecodeString(cookieValue)
+	if err != nil {
+		return "", "", ContextError(err)
+	}
+
+	if !useFronting {
+		cookieData, err = deobfuscateMeekCookie(obfuscationKey, cookieData)
+		if err != nil {
+			return "", "", ContextError(err)
+		}
+	}
+
+	if len(cookieData) < 32 {
+		return "", "", ContextError(errors.New("meek cookie too short"))
+	}
+	var ephemeralPublicKey [32]byte
+	copy(ephemeralPublicKey[:], cookieData[:32])
+
+	var nonce [24]byte
+	payload, ok := box.Open(nil, cookieData[32:], &nonce, &ephemeralPublicKey, serverPrivateKey)
+	if !ok {
+		return "", "", ContextError(errors.New("meek cookie box open failed"))
+	}
+
+	var data meekCookieData
+	if err := json.Unmarshal(payload, &data); err != nil {
+		return "", "", ContextError(err)
+	}
+	if data.MeekProtocolVersion != MEEK_PROTOCOL_VERSION {
+		return "", "", ContextError(errors.New("unsupported meek protocol version"))
+	}
+
+	return data.ServerAddress, data.SessionId, nil
+}
+
+// obfuscateMeekCookie XORs data with a keystream derived from a fresh random
+// seed and obfuscationKey, the same RC4-based construction used by the
+// obfuscated SSH layer, so that unfronted meek cookies don't look like
+// structured, encrypted data to an on-path observer, and so the keystream
+// differs for every cookie sent to a given server. The seed is prepended,
+// in cleartext, to the obfuscated bytes, as with the SSH layer's seed
+// message, so the server can rederive the same key.
+func obfuscateMeekCookie(obfuscationKey string, data []byte) ([]byte, error) {
+	seed := make([]byte, obfuscateMeekCookieSeedLength)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		return nil, ContextError(err)
+	}
+	cipher, err := rc4.NewCipher(deriveMeekCookieObfuscationKey(obfuscationKey, seed))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	obfuscated := make([]byte, len(data))
+	cipher.XORKeyStream(obfuscated, data)
+	return append(seed, obfuscated...), nil
+}
+
+// deobfuscateMeekCookie reverses obfuscateMeekCookie, given the same
+// obfuscationKey. It's used server-side to recover the NaCl box sealed by
+// makeMeekCookie from an unfronted meek cookie.
+func deobfuscateMeekCookie(obfuscationKey string, data []byte) ([]byte, error) {
+	if len(data) < obfuscateMeekCookieSeedLength {
+		return nil, ContextError(errors.New("obfuscated meek cookie too short"))
+	}
+	seed := data[:obfuscateMeekCookieSeedLength]
+	obfuscated := data[obfuscateMeekCookieSeedLength:]
+	cipher, err := rc4.NewCipher(deriveMeekCookieObfuscationKey(obfuscationKey, seed))
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	deobfuscated := make([]byte, len(obfuscated))
+	cipher.XORKeyStream(deobfuscated, obfuscated)
+	return deobfuscated, nil
+}
+
+// deriveMeekCookieObfuscationKey derives an RC4 key from seed and
+// obfuscationKey by repeated SHA-1 hashing, mirroring the obfuscated SSH
+// layer's seed-to-keystream derivation: mixing in a per-connection (here,
+// per-cookie) seed means the derived key, and so the keystream, differs
+// every time even though obfuscationKey is static for the server's lifetime.
+func deriveMeekCookieObfuscationKey(obfuscationKey string, seed []byte) []byte {
+	digest := sha1.Sum(append(append([]byte{}, seed...), []byte(obfuscationKey)...))
+	for i := 0; i < obfuscateMeekCookieKeyRounds; i++ {
+		digest = sha1.Sum(digest[:])
+	}
+	return digest[:]
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"code.google.com/p/go.crypto/nacl/box"
+)
+
+func TestObfuscateMeekCookieRoundTrip(t *testing.T) {
+	original := []byte("some sealed box bytes, arbitrary length")
+
+	obfuscated, err := obfuscateMeekCookie("obfuscation-key", original)
+	if err != nil {
+		t.Fatalf("obfuscateMeekCookie failed: %s", err)
+	}
+
+	deobfuscated, err := deobfuscateMeekCookie("obfuscation-key", obfuscated)
+	if err != nil {
+		t.Fatalf("deobfuscateMeekCookie failed: %s", err)
+	}
+
+	if !bytes.Equal(deobfuscated, original) {
+		t.Errorf("deobfuscated = %x, expected %x", deobfuscated, original)
+	}
+}
+
+func TestObfuscateMeekCookieVariesPerCall(t *testing.T) {
+	data := []byte("identical plaintext every time")
+
+	first, err := obfuscateMeekCookie("obfuscation-key", data)
+	if err != nil {
+		t.Fatalf("obfuscateMeekCookie failed: %s", err)
+	}
+	second, err := obfuscateMeekCookie("obfuscation-key", data)
+	if err != nil {
+		t.Fatalf("obfuscateMeekCookie failed: %s", err)
+	}
+
+	if bytes.Equal(first, second) {
+		t.Errorf("two obfuscations of the same data with the same key produced identical output")
+	}
+}
+
+func TestMakeMeekCookieRoundTrip(t *testing.T) {
+	serverPublicKey, serverPrivateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("box.GenerateKey failed: %s", err)
+	}
+
+	serverEntry := &ServerEntry{
+		IpAddress:                     "192.0.2.1",
+		SshObfuscatedKey:              "obfuscation-key",
+		MeekCookieEncryptionPublicKey: base64.StdEncoding.EncodeToString(serverPublicKey[:]),
+	}
+
+	cookie, err := makeMeekCookie(serverEntry, "session-id", false)
+	if err != nil {
+		t.Fatalf("makeMeekCookie failed: %s", err)
+	}
+
+	decodedCookie, err := base64.StdEncoding.DecodeString(cookie)
+	if err != nil {
+		t.Fatalf("failed to decode cookie: %s", err)
+	}
+
+	sealedBox, err := deobfuscateMeekCookie(serverEntry.SshObfuscatedKey, decodedCookie)
+	if err != nil {
+		t.Fatalf("deobfuscateMeekCookie failed: %s", err)
+	}
+
+	var ephemeralPublicKey [32]byte
+	copy(ephemeralPublicKey[:], sealedBox[:32])
+
+	var nonce [24]byte
+	payload, ok := box.Open(nil, sealedBox[32:], &nonce, &ephemeralPublicKey, serverPrivateKey)
+	if !ok {
+		t.Fatalf("box.Open failed")
+	}
+
+	var cookieData meekCookieData
+	if err := json.Unmarshal(payload, &cookieData); err != nil {
+		t.Fatalf("failed to unmarshal cookie payload: %s", err)
+	}
+
+	if cookieData.SessionId != "session-id" {
+		t.Errorf("SessionId = %q, expected %q", cookieData.SessionId, "session-id")
+	}
+	if cookieData.ServerAddress != serverEntry.IpAddress {
+		t.Errorf("ServerAddress = %q, expected %q", cookieData.ServerAddress, serverEntry.IpAddress)
+	}
+}
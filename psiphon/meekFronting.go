@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+// MEEK_MAX_FRONTING_ADDRESS_REGEX_LENGTH bounds the length of a fronting
+// address generated from MeekFrontingAddressesRegex, in case a pattern is
+// crafted (or misconfigured) to produce unreasonably long matches.
+const MEEK_MAX_FRONTING_ADDRESS_REGEX_LENGTH = 64
+
+// FrontingParameters specifies the fronting address and fronting host to use
+// for a single meek connection attempt, as selected by selectFrontingParameters.
+type FrontingParameters struct {
+	FrontingAddress string
+	FrontingHost    string
+}
+
+// selectFrontingParameters chooses the fronting address and fronting host to
+// use for one meek connection attempt to serverEntry.
+//
+// When MeekFrontingAddressesRegex is set, the fronting address is generated
+// to match the pattern -- e.g., "foo[a-z0-9]{8}\\.cloudfront\\.net" -- which
+// lets an operator describe a huge space of valid CDN addresses without
+// distributing every one of them in the server entry. Otherwise, a fronting
+// address is selected uniformly from MeekFrontingAddresses, as before.
+//
+// When present, the fronting host is selected uniformly from
+// MeekFrontingHosts, so the HTTP Host header presented to the fronting
+// provider can be varied independently of the address dialed. Rotating
+// these per connection, rather than fixing them for the life of a server
+// entry, resists enumeration of the fronting domain space by a censor.
+func selectFrontingParameters(serverEntry *ServerEntry) (*FrontingParameters, error) {
+
+	frontingParameters := new(FrontingParameters)
+
+	if serverEntry.MeekFrontingAddressesRegex != "" {
+		regexGenerator, err := NewRegexGenerator(
+			serverEntry.MeekFrontingAddressesRegex, MEEK_MAX_FRONTING_ADDRESS_REGEX_LENGTH)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		frontingAddress, err := regexGenerator.Generate()
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		frontingParameters.FrontingAddress = frontingAddress
+	} else if len(serverEntry.MeekFrontingAddresses) > 0 {
+		index, err := randomInt(len(serverEntry.MeekFrontingAddresses))
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		frontingParameters.FrontingAddress = serverEntry.MeekFrontingAddresses[index]
+	}
+
+	if len(serverEntry.MeekFrontingHosts) > 0 {
+		index, err := randomInt(len(serverEntry.MeekFrontingHosts))
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		frontingParameters.FrontingHost = serverEntry.MeekFrontingHosts[index]
+	}
+
+	return frontingParameters, nil
+}
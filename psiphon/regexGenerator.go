@@ -0,0 +1,201 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"regexp"
+	"regexp/syntax"
+)
+
+// RegexGenerator generates random strings that match a regular expression.
+// It walks the parsed regexp/syntax tree, choosing a random alternative at
+// each branch and a random count for each repetition, and emits literal
+// characters that satisfy the pattern.
+//
+// This is used to derive meek fronting addresses from a pattern such as
+// "foo[a-z0-9]{8}\\.cloudfront\\.net", so a server entry can describe a huge
+// space of valid CDN addresses without enumerating and distributing each one.
+type RegexGenerator struct {
+	syntaxTree *syntax.Regexp
+	matcher    *regexp.Regexp
+	maxLength  int
+}
+
+// NewRegexGenerator parses pattern and returns a RegexGenerator that
+// produces strings matching it, each no longer than maxLength.
+func NewRegexGenerator(pattern string, maxLength int) (*RegexGenerator, error) {
+	syntaxTree, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	matcher, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, ContextError(err)
+	}
+	return &RegexGenerator{syntaxTree: syntaxTree, matcher: matcher, maxLength: maxLength}, nil
+}
+
+// Generate returns a random string matching the generator's pattern. maxLength
+// can force generateMatch/generateRepeat to stop emitting output before a
+// mandatory, non-optional part of the pattern (e.g. a literal suffix after a
+// large repetition) has been written, which would otherwise silently produce
+// a string that doesn't actually match the pattern -- a broken fronting
+// address, in the case this is used for. A multi-byte rune written just
+// under the cap can also carry the output past maxLength. Validate against
+// the compiled pattern and maxLength before returning, rather than trust
+// that capping at maxLength always left a valid match.
+func (generator *RegexGenerator) Generate() (string, error) {
+	var buffer bytes.Buffer
+	err := generateMatch(generator.syntaxTree, &buffer, generator.maxLength)
+	if err != nil {
+		return "", ContextError(err)
+	}
+	generated := buffer.String()
+	if len(generated) > generator.maxLength || !generator.matcher.MatchString(generated) {
+		return "", ContextError(errors.New("regexGenerator: maxLength too small to generate a string matching the pattern"))
+	}
+	return generated, nil
+}
+
+func generateMatch(re *syntax.Regexp, buffer *bytes.Buffer, maxLength int) error {
+	if buffer.Len() >= maxLength {
+		return nil
+	}
+	switch re.Op {
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			if buffer.Len() >= maxLength {
+				return nil
+			}
+			buffer.WriteRune(r)
+		}
+	case syntax.OpCharClass:
+		r, err := randomRuneInClass(re.Rune)
+		if err != nil {
+			return ContextError(err)
+		}
+		buffer.WriteRune(r)
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		n, err := randomInt(26)
+		if err != nil {
+			return ContextError(err)
+		}
+		buffer.WriteRune(rune('a' + n))
+	case syntax.OpCapture:
+		return generateMatch(re.Sub[0], buffer, maxLength)
+	case syntax.OpConcat:
+		for _, sub := range re.Sub {
+			if err := generateMatch(sub, buffer, maxLength); err != nil {
+				return err
+			}
+		}
+	case syntax.OpAlternate:
+		n, err := randomInt(len(re.Sub))
+		if err != nil {
+			return ContextError(err)
+		}
+		return generateMatch(re.Sub[n], buffer, maxLength)
+	case syntax.OpStar:
+		return generateRepeat(re.Sub[0], buffer, maxLength, 0, 8)
+	case syntax.OpPlus:
+		return generateRepeat(re.Sub[0], buffer, maxLength, 1, 8)
+	case syntax.OpQuest:
+		return generateRepeat(re.Sub[0], buffer, maxLength, 0, 1)
+	case syntax.OpRepeat:
+		max := re.Max
+		if max < 0 {
+			max = re.Min + 8
+		}
+		return generateRepeat(re.Sub[0], buffer, maxLength, re.Min, max)
+	case syntax.OpEmptyMatch,
+		syntax.OpBeginLine, syntax.OpEndLine,
+		syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		// No output for these operators.
+	default:
+		return errors.New("regexGenerator: unsupported regex operator")
+	}
+	return nil
+}
+
+// generateRepeat emits between min and max (inclusive) random repetitions of re,
+// capped once buffer reaches maxLength.
+func generateRepeat(re *syntax.Regexp, buffer *bytes.Buffer, maxLength, min, max int) error {
+	if max < min {
+		max = min
+	}
+	count := min
+	if max > min {
+		n, err := randomInt(max - min + 1)
+		if err != nil {
+			return ContextError(err)
+		}
+		count += n
+	}
+	for i := 0; i < count; i++ {
+		if buffer.Len() >= maxLength {
+			return nil
+		}
+		if err := generateMatch(re, buffer, maxLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func randomRuneInClass(ranges []rune) (rune, error) {
+	if len(ranges) == 0 || len(ranges)%2 != 0 {
+		return 0, errors.New("regexGenerator: invalid character class")
+	}
+	total := 0
+	for i := 0; i < len(ranges); i += 2 {
+		total += int(ranges[i+1]-ranges[i]) + 1
+	}
+	if total <= 0 {
+		return 0, errors.New("regexGenerator: empty character class")
+	}
+	n, err := randomInt(total)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	for i := 0; i < len(ranges); i += 2 {
+		width := int(ranges[i+1]-ranges[i]) + 1
+		if n < width {
+			return ranges[i] + rune(n), nil
+		}
+		n -= width
+	}
+	return 0, errors.New("regexGenerator: unreachable")
+}
+
+func randomInt(n int) (int, error) {
+	if n <= 0 {
+		return 0, nil
+	}
+	value, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	return int(value.Int64()), nil
+}
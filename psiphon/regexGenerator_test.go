@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRegexGeneratorMatchesPattern(t *testing.T) {
+	patterns := []string{
+		`foo[a-z0-9]{8}\.cloudfront\.net`,
+		`(a|b|c)+`,
+		`[A-Za-z]*\.example\.com`,
+		`x?y*z+`,
+	}
+
+	for _, pattern := range patterns {
+		generator, err := NewRegexGenerator(pattern, 64)
+		if err != nil {
+			t.Fatalf("NewRegexGenerator(%q) failed: %s", pattern, err)
+		}
+
+		matcher, err := regexp.Compile("^" + pattern + "$")
+		if err != nil {
+			t.Fatalf("regexp.Compile(%q) failed: %s", pattern, err)
+		}
+
+		for i := 0; i < 100; i++ {
+			generated, err := generator.Generate()
+			if err != nil {
+				t.Fatalf("Generate() failed for pattern %q: %s", pattern, err)
+			}
+			if !matcher.MatchString(generated) {
+				t.Errorf("pattern %q generated %q, which doesn't match", pattern, generated)
+			}
+		}
+	}
+}
+
+func TestRegexGeneratorRespectsMaxLength(t *testing.T) {
+	generator, err := NewRegexGenerator(`a+`, 10)
+	if err != nil {
+		t.Fatalf("NewRegexGenerator failed: %s", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		generated, err := generator.Generate()
+		if err != nil {
+			t.Fatalf("Generate() failed: %s", err)
+		}
+		if len(generated) > 10 {
+			t.Errorf("generated string %q exceeds maxLength 10", generated)
+		}
+	}
+}
+
+func TestRegexGeneratorRejectsInvalidPattern(t *testing.T) {
+	_, err := NewRegexGenerator(`[`, 10)
+	if err == nil {
+		t.Errorf("expected an error for an invalid regex pattern")
+	}
+}
+
+// TestRegexGeneratorRejectsTruncationThatBreaksTheMatch exercises a pattern
+// whose minimum matching length exceeds maxLength: a{20} alone exhausts the
+// cap, leaving no room for the mandatory literal "b" suffix. Generate must
+// report an error rather than silently return a string that doesn't match
+// the pattern.
+func TestRegexGeneratorRejectsTruncationThatBreaksTheMatch(t *testing.T) {
+	generator, err := NewRegexGenerator(`a{20}b`, 5)
+	if err != nil {
+		t.Fatalf("NewRegexGenerator failed: %s", err)
+	}
+
+	_, err = generator.Generate()
+	if err == nil {
+		t.Errorf("expected an error when maxLength is too small to match the pattern")
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"code.google.com/p/go.crypto/ssh"
+)
+
+// decodeAuthorizedPublicKeys decodes a list of base64-encoded, marshalled
+// SSH public keys, as distributed in a server entry's certificate authority
+// list, into ssh.PublicKey values suitable for use in an ssh.CertChecker.
+func decodeAuthorizedPublicKeys(encodedPublicKeys []string) (publicKeys []ssh.PublicKey, err error) {
+	for _, encodedPublicKey := range encodedPublicKeys {
+		keyBytes, err := base64.StdEncoding.DecodeString(encodedPublicKey)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		publicKey, err := ssh.ParsePublicKey(keyBytes)
+		if err != nil {
+			return nil, ContextError(err)
+		}
+		publicKeys = append(publicKeys, publicKey)
+	}
+	return publicKeys, nil
+}
+
+// isHostCertificateAuthority returns true if authority is present in
+// hostCertificateAuthorities, as decoded by decodeAuthorizedPublicKeys from a
+// server entry's certificate authority list. It implements the
+// ssh.CertChecker.IsHostAuthority callback used by EstablishTunnel to decide
+// whether a host certificate's signing key is one the client was told to
+// trust -- getting this comparison wrong would mean either accepting a host
+// certificate signed by an untrusted authority, or rejecting one from a
+// legitimate authority the server entry did list.
+func isHostCertificateAuthority(hostCertificateAuthorities []ssh.PublicKey) func(ssh.PublicKey, string) bool {
+	return func(authority ssh.PublicKey, address string) bool {
+		for _, hostCertificateAuthority := range hostCertificateAuthorities {
+			if bytes.Equal(hostCertificateAuthority.Marshal(), authority.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// NewCertSigner issues a short-lived SSH host certificate for hostKey, signed
+// by authorityKey, and returns an ssh.Signer that presents the certificate
+// instead of the bare host key.
+//
+// This is the server-side counterpart to the host certificate authority
+// support in EstablishTunnel: operators run this (or equivalent provisioning
+// tooling) to rotate a server's host key without redistributing a new server
+// entry to every client, so long as the client already trusts the authority
+// key used here.
+func NewCertSigner(
+	hostKey interface{},
+	authorityKey interface{},
+	validBefore time.Time,
+	hostAddress string) (ssh.Signer, error) {
+
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	authoritySigner, err := ssh.NewSignerFromKey(authorityKey)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	certificate := &ssh.Certificate{
+		Key:             hostSigner.PublicKey(),
+		Serial:          uint64(validBefore.Unix()),
+		CertType:        ssh.HostCert,
+		ValidPrincipals: []string{hostAddress},
+		ValidAfter:      uint64(validBefore.Add(-24 * time.Hour).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	err = certificate.SignCert(rand.Reader, authoritySigner)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	certSigner, err := ssh.NewCertSigner(certificate, hostSigner)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	return certSigner, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"code.google.com/p/go.crypto/ssh"
+)
+
+func generateTestSshPublicKey(t *testing.T) ssh.PublicKey {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		t.Fatalf("ssh.NewSignerFromKey failed: %s", err)
+	}
+	return signer.PublicKey()
+}
+
+func TestIsHostCertificateAuthorityAcceptsTrustedAuthority(t *testing.T) {
+	trustedAuthority := generateTestSshPublicKey(t)
+	otherAuthority := generateTestSshPublicKey(t)
+
+	isAuthority := isHostCertificateAuthority([]ssh.PublicKey{otherAuthority, trustedAuthority})
+
+	if !isAuthority(trustedAuthority, "example.com:22") {
+		t.Errorf("expected a listed authority to be trusted")
+	}
+}
+
+func TestIsHostCertificateAuthorityRejectsUntrustedAuthority(t *testing.T) {
+	trustedAuthority := generateTestSshPublicKey(t)
+	untrustedAuthority := generateTestSshPublicKey(t)
+
+	isAuthority := isHostCertificateAuthority([]ssh.PublicKey{trustedAuthority})
+
+	if isAuthority(untrustedAuthority, "example.com:22") {
+		t.Errorf("expected an unlisted authority to be rejected")
+	}
+}
@@ -27,6 +27,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -70,6 +71,14 @@ type Tunnel struct {
 	sshKeepAliveQuit        chan struct{}
 	portForwardFailures     chan int
 	portForwardFailureTotal int
+	udpgwMutex              sync.Mutex
+	udpgwChannel            net.Conn
+	udpgwFlows              map[uint16]*udpgwFlow
+	udpgwNextConnId         uint16
+	udpgwReapQuit           chan struct{}
+	udpgwWriteMutex         sync.Mutex
+	dialStats               *DialStats
+	activityConn            *ActivityMonitoredConn
 }
 
 // EstablishTunnel first makes a network transport connection to the
@@ -150,8 +159,23 @@ func EstablishTunnel(
 		BindToDeviceServiceAddress: config.BindToDeviceServiceAddress,
 		BindToDeviceDnsServer:      config.BindToDeviceDnsServer,
 	}
+	dialStats := &DialStats{Protocol: selectedProtocol}
+	totalStartTime := time.Now()
+
 	var conn Conn
+	connectStartTime := time.Now()
 	if useMeek {
+		if useFronting {
+			dialConfig.FrontingParameters, err = selectFrontingParameters(serverEntry)
+			if err != nil {
+				return nil, ContextError(err)
+			}
+			dialStats.MeekFrontingHost = dialConfig.FrontingParameters.FrontingHost
+		}
+		dialConfig.MeekCookie, err = makeMeekCookie(serverEntry, sessionId, useFronting)
+		if err != nil {
+			return nil, ContextError(err)
+		}
 		conn, err = DialMeek(serverEntry, sessionId, useFronting, dialConfig)
 		if err != nil {
 			return nil, ContextError(err)
@@ -165,6 +189,7 @@ func EstablishTunnel(
 			return nil, ContextError(err)
 		}
 	}
+	dialStats.ConnectElapsedTime = time.Now().Sub(connectStartTime)
 	defer func() {
 		// Cleanup on error
 		if err != nil {
@@ -173,6 +198,7 @@ func EstablishTunnel(
 	}()
 
 	// Add obfuscated SSH layer
+	obfuscationStartTime := time.Now()
 	var sshConn net.Conn
 	sshConn = conn
 	if useObfuscatedSsh {
@@ -181,13 +207,36 @@ func EstablishTunnel(
 			return nil, ContextError(err)
 		}
 	}
+	dialStats.ObfuscationElapsedTime = time.Now().Sub(obfuscationStartTime)
+
+	// Track read/write activity and byte counts on the conn presented to the SSH
+	// layer. This supports idle-triggered keepalives and per-tunnel activity stats.
+	// dialResult bundles the dialed conn, the activity-monitored SSH transport,
+	// and the stats accumulated so far, for use in completing the SSH handshake
+	// below and for retention on the Tunnel via GetDialStats().
+	dialResult := &DialResult{
+		Conn:    conn,
+		SshConn: NewActivityMonitoredConn(sshConn),
+		Stats:   dialStats,
+	}
+	sshConn = dialResult.SshConn
 
 	// Now establish the SSH session over the sshConn transport
 	expectedPublicKey, err := base64.StdEncoding.DecodeString(serverEntry.SshHostKey)
 	if err != nil {
 		return nil, ContextError(err)
 	}
+	// In addition to the legacy HostKeyFallback check against the pinned host key in
+	// the server entry, accept host keys presented as certificates signed by one of
+	// the server entry's trusted certificate authorities. This allows a server's host
+	// key to be rotated, on a schedule, without requiring a new server entry to be
+	// distributed to clients.
+	hostCertificateAuthorities, err := decodeAuthorizedPublicKeys(serverEntry.SshHostCertificateAuthorities)
+	if err != nil {
+		return nil, ContextError(err)
+	}
 	sshCertChecker := &ssh.CertChecker{
+		IsHostAuthority: isHostCertificateAuthority(hostCertificateAuthorities),
 		HostKeyFallback: func(addr string, remote net.Addr, publicKey ssh.PublicKey) error {
 			if !bytes.Equal(expectedPublicKey, publicKey.Marshal()) {
 				return ContextError(errors.New("unexpected host public key"))
@@ -210,47 +259,69 @@ func EstablishTunnel(
 		},
 		HostKeyCallback: sshCertChecker.CheckHostKey,
 	}
-	// The folowing is adapted from ssh.Dial(), here using a custom conn
-	// The sshAddress is passed through to host key verification callbacks; we don't use it.
-	sshAddress := ""
+	// The following is adapted from ssh.Dial(), here using a custom conn.
+	// sshAddress is passed through to sshCertChecker.CheckHostKey, which
+	// calls net.SplitHostPort on it before checking the host certificate's
+	// principals, so it must be the real dial address, not a placeholder.
+	sshAddress := fmt.Sprintf("%s:%d", serverEntry.IpAddress, port)
+	sshHandshakeStartTime := time.Now()
 	sshClientConn, sshChans, sshReqs, err := ssh.NewClientConn(sshConn, sshAddress, sshClientConfig)
 	if err != nil {
 		return nil, ContextError(err)
 	}
 	sshClient := ssh.NewClient(sshClientConn, sshChans, sshReqs)
+	dialStats.SshHandshakeElapsedTime = time.Now().Sub(sshHandshakeStartTime)
+	dialStats.TotalElapsedTime = time.Now().Sub(totalStartTime)
+	dialStats.BytesUp = dialResult.SshConn.BytesWritten()
+	dialStats.BytesDown = dialResult.SshConn.BytesRead()
 
-	// Run a goroutine to periodically execute SSH keepalive
+	// Run a goroutine that sends an SSH keepalive only once the conn has been
+	// idle -- neither read from nor written to -- for at least
+	// TUNNEL_SSH_KEEP_ALIVE_PERIOD, rather than on a fixed ticker regardless of
+	// activity. This avoids needless keepalive traffic on a tunnel that's
+	// already being exercised by port forwards.
 	sshKeepAliveQuit := make(chan struct{})
-	sshKeepAliveTicker := time.NewTicker(TUNNEL_SSH_KEEP_ALIVE_PERIOD)
 	go func() {
+		ticker := time.NewTicker(TUNNEL_SSH_KEEP_ALIVE_PERIOD / 4)
+		defer ticker.Stop()
 		for {
 			select {
-			case <-sshKeepAliveTicker.C:
+			case <-ticker.C:
+				if time.Now().Sub(dialResult.SshConn.LastActiveTime()) < TUNNEL_SSH_KEEP_ALIVE_PERIOD {
+					continue
+				}
 				_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
 				if err != nil {
 					Notice(NOTICE_ALERT, "ssh keep alive failed: %s", err)
 					// TODO: call Tunnel.Close()?
-					sshKeepAliveTicker.Stop()
 					conn.Close()
+					return
 				}
 			case <-sshKeepAliveQuit:
-				sshKeepAliveTicker.Stop()
 				return
 			}
 		}
 	}()
 
-	return &Tunnel{
-			serverEntry:      serverEntry,
-			sessionId:        sessionId,
-			protocol:         selectedProtocol,
-			conn:             conn,
-			sshClient:        sshClient,
-			sshKeepAliveQuit: sshKeepAliveQuit,
-			// portForwardFailures buffer size is large enough to receive the thresold number
-			// of failure reports without blocking. Senders can drop failures without blocking.
-			portForwardFailures: make(chan int, config.PortForwardFailureThreshold)},
-		nil
+	tunnel = &Tunnel{
+		serverEntry:      serverEntry,
+		sessionId:        sessionId,
+		protocol:         selectedProtocol,
+		conn:             conn,
+		sshClient:        sshClient,
+		sshKeepAliveQuit: sshKeepAliveQuit,
+		// portForwardFailures buffer size is large enough to receive the thresold number
+		// of failure reports without blocking. Senders can drop failures without blocking.
+		portForwardFailures: make(chan int, config.PortForwardFailureThreshold),
+		udpgwFlows:          make(map[uint16]*udpgwFlow),
+		udpgwReapQuit:       make(chan struct{}),
+		dialStats:           dialStats,
+		activityConn:        dialResult.SshConn,
+	}
+
+	go tunnel.reapIdleUdpgwFlows()
+
+	return tunnel, nil
 }
 
 // Close terminates the tunnel.
@@ -258,6 +329,17 @@ func (tunnel *Tunnel) Close() {
 	if tunnel.sshKeepAliveQuit != nil {
 		close(tunnel.sshKeepAliveQuit)
 	}
+	if tunnel.udpgwReapQuit != nil {
+		close(tunnel.udpgwReapQuit)
+	}
+	tunnel.udpgwMutex.Lock()
+	for _, flow := range tunnel.udpgwFlows {
+		flow.close()
+	}
+	if tunnel.udpgwChannel != nil {
+		tunnel.udpgwChannel.Close()
+	}
+	tunnel.udpgwMutex.Unlock()
 	if tunnel.conn != nil {
 		tunnel.conn.Close()
 	}
@@ -271,7 +353,8 @@ func (tunnel *Tunnel) SetSessionStarted() {
 	atomic.StoreInt32(&tunnel.sessionStarted, 1)
 }
 
-// Dial establishes a port forward connection through the tunnel
+// Dial establishes a TCP port forward connection through the tunnel.
+// For UDP traffic, such as DNS or QUIC, use DialUDP instead.
 func (tunnel *Tunnel) Dial(remoteAddr string) (conn net.Conn, err error) {
 	// TODO: should this track port forward failures as in Controller.DialWithTunnel?
 	return tunnel.sshClient.Dial("tcp", remoteAddr)
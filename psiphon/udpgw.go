@@ -0,0 +1,445 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// udpgw multiplexes UDP datagrams over a single SSH direct-tcpip channel to
+// a server-side udpgw endpoint. This unblocks UDP-based protocols, such as
+// DNS-over-UDP and QUIC, which otherwise can't be carried through the
+// tunnel since sshClient.Dial only offers a TCP stream primitive.
+//
+// Frame format, sent in both directions, each frame preceded by a 2-byte
+// (big-endian) length of everything that follows:
+//
+//	flags (1 byte); connection ID (2 bytes, big-endian);
+//	[if flags&udpgwFlagNewConnection: address length (1 byte); address]
+//	payload (remainder of the frame)
+//
+// The server associates the connection ID with the addr:port given in a
+// udpgwFlagNewConnection frame, and datagrams may then be sent in either
+// direction using just the connection ID.
+const (
+	udpgwFlagNewConnection = 0x01
+	udpgwFlagKeepAlive     = 0x02
+)
+
+// UDPGW_IDLE_TIMEOUT is how long a UDP flow may go without activity before
+// it's reaped and its connection ID recycled.
+const UDPGW_IDLE_TIMEOUT = 2 * time.Minute
+
+// udpgwFlow is one multiplexed UDP flow: the per-flow read side of
+// udpgwPacketConn, fed by the tunnel's demultiplexing goroutine.
+type udpgwFlow struct {
+	connId       uint16
+	remoteAddr   *net.UDPAddr
+	packets      chan []byte
+	closeOnce    chan struct{}
+	lastActivity int64 // unix seconds, accessed via sync/atomic
+
+	readDeadline  int64 // unix nanoseconds; 0 means no deadline; accessed via sync/atomic
+	writeDeadline int64 // unix nanoseconds; 0 means no deadline; accessed via sync/atomic
+
+	// registeredChannel is the udpgwChannel this flow's udpgwFlagNewConnection
+	// frame was last sent on, guarded by tunnel.udpgwMutex. When it no longer
+	// matches the current channel, WriteTo re-registers the flow's connId and
+	// remoteAddr with the current channel before sending plain data frames.
+	// Flows that are open when the channel fails are closed by
+	// runUdpgwDemultiplexer, and WriteTo on a closed flow returns an error.
+	registeredChannel net.Conn
+}
+
+func (flow *udpgwFlow) close() {
+	select {
+	case <-flow.closeOnce:
+	default:
+		close(flow.closeOnce)
+	}
+}
+
+func (flow *udpgwFlow) touch() {
+	atomic.StoreInt64(&flow.lastActivity, time.Now().Unix())
+}
+
+// udpgwPacketConn is a net.PacketConn backed by one multiplexed udpgw flow.
+type udpgwPacketConn struct {
+	tunnel *Tunnel
+	flow   *udpgwFlow
+}
+
+// DialUDP establishes a UDP "connection" to remoteAddr through the tunnel,
+// multiplexed with any other UDP flows over a single SSH channel to the
+// server's udpgw endpoint.
+func (tunnel *Tunnel) DialUDP(remoteAddr string) (net.PacketConn, error) {
+
+	udpAddr, err := net.ResolveUDPAddr("udp", remoteAddr)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	channel, err := tunnel.dialUdpgwChannel()
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	flow := &udpgwFlow{
+		remoteAddr: udpAddr,
+		packets:    make(chan []byte, 32),
+		closeOnce:  make(chan struct{}),
+	}
+	flow.touch()
+
+	tunnel.udpgwMutex.Lock()
+	tunnel.udpgwNextConnId++
+	flow.connId = tunnel.udpgwNextConnId
+	tunnel.udpgwFlows[flow.connId] = flow
+	tunnel.udpgwMutex.Unlock()
+
+	frame, err := makeUdpgwFrame(udpgwFlagNewConnection, flow.connId, remoteAddr, nil)
+	if err != nil {
+		tunnel.removeUdpgwFlow(flow.connId)
+		return nil, ContextError(err)
+	}
+	if err := tunnel.writeUdpgwFrame(channel, frame); err != nil {
+		tunnel.removeUdpgwFlow(flow.connId)
+		return nil, ContextError(err)
+	}
+	tunnel.udpgwMutex.Lock()
+	flow.registeredChannel = channel
+	tunnel.udpgwMutex.Unlock()
+
+	return &udpgwPacketConn{tunnel: tunnel, flow: flow}, nil
+}
+
+// writeUdpgwFrame writes frame to the shared udpgw channel under
+// udpgwWriteMutex. All of a tunnel's UDP flows are multiplexed over one
+// net.Conn, and net.Conn.Write offers no guarantee that concurrent callers'
+// writes won't interleave; an interleaved write would corrupt the
+// length-prefixed framing for every flow sharing the channel, not just the
+// caller's. This mutex is distinct from udpgwMutex, which guards the flow
+// map and channel pointer, not the write itself.
+func (tunnel *Tunnel) writeUdpgwFrame(channel net.Conn, frame []byte) error {
+	tunnel.udpgwWriteMutex.Lock()
+	defer tunnel.udpgwWriteMutex.Unlock()
+	_, err := channel.Write(frame)
+	return err
+}
+
+// dialUdpgwChannel lazily opens the single direct-tcpip channel to the
+// server's udpgw endpoint used by all of this tunnel's UDP flows, and
+// starts the goroutine that demultiplexes replies back to per-flow
+// udpgwPacketConns.
+func (tunnel *Tunnel) dialUdpgwChannel() (net.Conn, error) {
+	tunnel.udpgwMutex.Lock()
+	defer tunnel.udpgwMutex.Unlock()
+
+	if tunnel.udpgwChannel != nil {
+		return tunnel.udpgwChannel, nil
+	}
+
+	if tunnel.serverEntry.UdpgwServerAddress == "" {
+		return nil, ContextError(errors.New("server does not support udpgw"))
+	}
+
+	channel, err := tunnel.sshClient.Dial("tcp", tunnel.serverEntry.UdpgwServerAddress)
+	if err != nil {
+		return nil, ContextError(err)
+	}
+
+	tunnel.udpgwChannel = channel
+
+	go tunnel.runUdpgwDemultiplexer(channel)
+
+	return channel, nil
+}
+
+// runUdpgwDemultiplexer reads frames from the shared udpgw channel and
+// dispatches each one's payload to the matching flow's packets channel.
+func (tunnel *Tunnel) runUdpgwDemultiplexer(channel net.Conn) {
+	for {
+		_, connId, payload, err := readUdpgwFrame(channel)
+		if err != nil {
+			Notice(NOTICE_ALERT, "udpgw demultiplexer failed: %s", err)
+			tunnel.udpgwMutex.Lock()
+			for _, flow := range tunnel.udpgwFlows {
+				flow.close()
+			}
+			tunnel.udpgwChannel = nil
+			tunnel.udpgwMutex.Unlock()
+			return
+		}
+		tunnel.udpgwMutex.Lock()
+		flow, ok := tunnel.udpgwFlows[connId]
+		tunnel.udpgwMutex.Unlock()
+		if !ok {
+			continue
+		}
+		flow.touch()
+		select {
+		case flow.packets <- payload:
+		case <-flow.closeOnce:
+		}
+	}
+}
+
+// reapIdleUdpgwFlows periodically closes UDP flows that have seen no
+// activity for longer than UDPGW_IDLE_TIMEOUT.
+func (tunnel *Tunnel) reapIdleUdpgwFlows() {
+	ticker := time.NewTicker(UDPGW_IDLE_TIMEOUT / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cutoff := time.Now().Add(-UDPGW_IDLE_TIMEOUT).Unix()
+			tunnel.udpgwMutex.Lock()
+			for connId, flow := range tunnel.udpgwFlows {
+				if atomic.LoadInt64(&flow.lastActivity) < cutoff {
+					flow.close()
+					delete(tunnel.udpgwFlows, connId)
+				}
+			}
+			tunnel.udpgwMutex.Unlock()
+		case <-tunnel.udpgwReapQuit:
+			return
+		}
+	}
+}
+
+func (tunnel *Tunnel) removeUdpgwFlow(connId uint16) {
+	tunnel.udpgwMutex.Lock()
+	if flow, ok := tunnel.udpgwFlows[connId]; ok {
+		flow.close()
+		delete(tunnel.udpgwFlows, connId)
+	}
+	tunnel.udpgwMutex.Unlock()
+}
+
+func (conn *udpgwPacketConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	timer := deadlineTimer(atomic.LoadInt64(&conn.flow.readDeadline))
+	if timer != nil {
+		defer timer.Stop()
+	}
+	select {
+	case payload, ok := <-conn.flow.packets:
+		if !ok {
+			return 0, nil, errors.New("udpgw: flow closed")
+		}
+		return copy(buffer, payload), conn.flow.remoteAddr, nil
+	case <-conn.flow.closeOnce:
+		return 0, nil, errors.New("udpgw: flow closed")
+	case <-timerChannel(timer):
+		return 0, nil, udpgwTimeoutError{}
+	}
+}
+
+func (conn *udpgwPacketConn) WriteTo(buffer []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.flow.closeOnce:
+		return 0, errors.New("udpgw: flow closed")
+	default:
+	}
+
+	channel, err := conn.tunnel.dialUdpgwChannel()
+	if err != nil {
+		return 0, ContextError(err)
+	}
+	conn.flow.touch()
+
+	// If the current channel is not the one this flow was registered on (the
+	// channel was redialed after the closed check above), its server side has
+	// never heard of this flow's connId: re-send the udpgwFlagNewConnection
+	// registration ahead of the data, rather than silently writing an
+	// unrecognized connId into a void.
+	conn.tunnel.udpgwMutex.Lock()
+	address := ""
+	if conn.flow.registeredChannel != channel {
+		address = conn.flow.remoteAddr.String()
+		conn.flow.registeredChannel = channel
+	}
+	conn.tunnel.udpgwMutex.Unlock()
+
+	frame, err := makeUdpgwFrame(0, conn.flow.connId, address, buffer)
+	if err != nil {
+		return 0, ContextError(err)
+	}
+
+	timer := deadlineTimer(atomic.LoadInt64(&conn.flow.writeDeadline))
+	if timer != nil {
+		defer timer.Stop()
+	}
+
+	writeDone := make(chan error, 1)
+	go func() { writeDone <- conn.tunnel.writeUdpgwFrame(channel, frame) }()
+
+	select {
+	case err := <-writeDone:
+		if err != nil {
+			return 0, ContextError(err)
+		}
+		return len(buffer), nil
+	case <-conn.flow.closeOnce:
+		return 0, errors.New("udpgw: flow closed")
+	case <-timerChannel(timer):
+		return 0, udpgwTimeoutError{}
+	}
+}
+
+func (conn *udpgwPacketConn) Close() error {
+	conn.tunnel.removeUdpgwFlow(conn.flow.connId)
+	return nil
+}
+
+func (conn *udpgwPacketConn) LocalAddr() net.Addr { return conn.flow.remoteAddr }
+
+func (conn *udpgwPacketConn) SetDeadline(t time.Time) error {
+	atomic.StoreInt64(&conn.flow.readDeadline, deadlineNano(t))
+	atomic.StoreInt64(&conn.flow.writeDeadline, deadlineNano(t))
+	return nil
+}
+
+func (conn *udpgwPacketConn) SetReadDeadline(t time.Time) error {
+	atomic.StoreInt64(&conn.flow.readDeadline, deadlineNano(t))
+	return nil
+}
+
+func (conn *udpgwPacketConn) SetWriteDeadline(t time.Time) error {
+	atomic.StoreInt64(&conn.flow.writeDeadline, deadlineNano(t))
+	return nil
+}
+
+// udpgwTimeoutError is returned by ReadFrom/WriteTo once the deadline set
+// via SetDeadline/SetReadDeadline/SetWriteDeadline has passed. It
+// implements net.Error so callers that rely on a type-asserted Timeout()
+// to distinguish a timeout from a hard failure -- as both Go's resolver and
+// QUIC's loss recovery do -- can tell the two apart and retry.
+type udpgwTimeoutError struct{}
+
+func (udpgwTimeoutError) Error() string   { return "udpgw: i/o timeout" }
+func (udpgwTimeoutError) Timeout() bool   { return true }
+func (udpgwTimeoutError) Temporary() bool { return true }
+
+var _ net.Error = udpgwTimeoutError{}
+
+// deadlineNano converts a deadline, as passed to SetDeadline and friends,
+// to the unix-nanoseconds form stored in udpgwFlow, with the zero Time
+// (meaning no deadline) mapping to 0.
+func deadlineNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// deadlineTimer returns a timer firing when the unix-nanosecond deadline
+// produced by deadlineNano is reached, or nil if deadlineNano is 0 (no
+// deadline), in which case timerChannel's nil channel blocks forever in a
+// select, as desired. The caller must Stop a non-nil timer once done.
+func deadlineTimer(deadlineNano int64) *time.Timer {
+	if deadlineNano == 0 {
+		return nil
+	}
+	return time.NewTimer(time.Until(time.Unix(0, deadlineNano)))
+}
+
+func timerChannel(timer *time.Timer) <-chan time.Time {
+	if timer == nil {
+		return nil
+	}
+	return timer.C
+}
+
+// makeUdpgwFrame builds one length-prefixed udpgw frame. When address is
+// non-empty, udpgwFlagNewConnection is added to flags and the address is
+// included ahead of the payload.
+func makeUdpgwFrame(flags byte, connId uint16, address string, payload []byte) ([]byte, error) {
+	body := make([]byte, 0, 3+len(address)+1+len(payload))
+	if address != "" {
+		flags |= udpgwFlagNewConnection
+	}
+	body = append(body, flags)
+	body = append(body, byte(connId>>8), byte(connId))
+	if address != "" {
+		if len(address) > 255 {
+			return nil, errors.New("udpgw: address too long")
+		}
+		body = append(body, byte(len(address)))
+		body = append(body, []byte(address)...)
+	}
+	body = append(body, payload...)
+
+	if len(body) > 0xffff {
+		return nil, errors.New("udpgw: frame too large")
+	}
+	frame := make([]byte, 2+len(body))
+	binary.BigEndian.PutUint16(frame, uint16(len(body)))
+	copy(frame[2:], body)
+	return frame, nil
+}
+
+// readUdpgwFrame reads and parses one length-prefixed udpgw frame from conn.
+func readUdpgwFrame(conn net.Conn) (flags byte, connId uint16, payload []byte, err error) {
+	lengthBytes := make([]byte, 2)
+	if _, err := readFull(conn, lengthBytes); err != nil {
+		return 0, 0, nil, ContextError(err)
+	}
+	length := binary.BigEndian.Uint16(lengthBytes)
+	if length < 3 {
+		return 0, 0, nil, errors.New("udpgw: frame too short")
+	}
+	body := make([]byte, length)
+	if _, err := readFull(conn, body); err != nil {
+		return 0, 0, nil, ContextError(err)
+	}
+
+	flags = body[0]
+	connId = uint16(body[1])<<8 | uint16(body[2])
+	offset := 3
+	if flags&udpgwFlagNewConnection != 0 {
+		if offset >= len(body) {
+			return 0, 0, nil, errors.New("udpgw: missing address length")
+		}
+		addressLength := int(body[offset])
+		offset++
+		offset += addressLength
+		if offset > len(body) {
+			return 0, 0, nil, errors.New("udpgw: truncated address")
+		}
+	}
+	return flags, connId, body[offset:], nil
+}
+
+// readFull reads exactly len(buffer) bytes from conn.
+func readFull(conn net.Conn, buffer []byte) (int, error) {
+	total := 0
+	for total < len(buffer) {
+		n, err := conn.Read(buffer[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package psiphon
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUdpgwFrameRoundTrip(t *testing.T) {
+	frame, err := makeUdpgwFrame(0, 42, "example.com:53", []byte("payload"))
+	if err != nil {
+		t.Fatalf("makeUdpgwFrame failed: %s", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write(frame)
+	}()
+
+	flags, connId, payload, err := readUdpgwFrame(server)
+	if err != nil {
+		t.Fatalf("readUdpgwFrame failed: %s", err)
+	}
+	if flags&udpgwFlagNewConnection == 0 {
+		t.Errorf("expected udpgwFlagNewConnection to be set when address is non-empty")
+	}
+	if connId != 42 {
+		t.Errorf("connId = %d, expected 42", connId)
+	}
+	if !bytes.Equal(payload, []byte("payload")) {
+		t.Errorf("payload = %q, expected %q", payload, "payload")
+	}
+}
+
+func TestUdpgwFrameRejectsOversizedAddress(t *testing.T) {
+	_, err := makeUdpgwFrame(0, 1, string(make([]byte, 256)), nil)
+	if err == nil {
+		t.Errorf("expected an error for an address longer than 255 bytes")
+	}
+}
+
+// TestTunnelWriteUdpgwFrameSerializesWrites exercises writeUdpgwFrame with
+// many concurrent callers sharing one net.Conn, asserting that every frame
+// written is read back intact: a torn write would corrupt the length
+// prefix of a frame other than the one that produced it.
+func TestTunnelWriteUdpgwFrameSerializesWrites(t *testing.T) {
+	const numWriters = 16
+	const framesPerWriter = 16
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	tunnel := &Tunnel{}
+
+	var writersWaitGroup sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		writersWaitGroup.Add(1)
+		go func(connId uint16) {
+			defer writersWaitGroup.Done()
+			for j := 0; j < framesPerWriter; j++ {
+				frame, err := makeUdpgwFrame(0, connId, "", []byte("datagram"))
+				if err != nil {
+					t.Errorf("makeUdpgwFrame failed: %s", err)
+					return
+				}
+				if err := tunnel.writeUdpgwFrame(client, frame); err != nil {
+					t.Errorf("writeUdpgwFrame failed: %s", err)
+					return
+				}
+			}
+		}(uint16(i))
+	}
+
+	readsDone := make(chan struct{})
+	go func() {
+		defer close(readsDone)
+		for i := 0; i < numWriters*framesPerWriter; i++ {
+			_, _, payload, err := readUdpgwFrame(server)
+			if err != nil {
+				t.Errorf("readUdpgwFrame failed: %s", err)
+				return
+			}
+			if !bytes.Equal(payload, []byte("datagram")) {
+				t.Errorf("payload = %q, expected %q", payload, "datagram")
+				return
+			}
+		}
+	}()
+
+	writersWaitGroup.Wait()
+	<-readsDone
+}
+
+// TestUdpgwPacketConnReadFromHonorsReadDeadline exercises the deadline
+// semantics DNS-over-UDP and QUIC depend on to detect a lost datagram:
+// without a packet to deliver, ReadFrom must return a timeout error, not
+// block forever.
+func TestUdpgwPacketConnReadFromHonorsReadDeadline(t *testing.T) {
+	flow := &udpgwFlow{
+		packets:   make(chan []byte),
+		closeOnce: make(chan struct{}),
+	}
+	conn := &udpgwPacketConn{flow: flow}
+
+	conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	_, _, err := conn.ReadFrom(make([]byte, 1500))
+	if err == nil {
+		t.Fatalf("expected a timeout error")
+	}
+	netErr, ok := err.(net.Error)
+	if !ok || !netErr.Timeout() {
+		t.Errorf("err = %v, expected a net.Error with Timeout() true", err)
+	}
+}
+
+func TestUdpgwPacketConnReadFromReturnsBeforeDeadline(t *testing.T) {
+	flow := &udpgwFlow{
+		packets:   make(chan []byte, 1),
+		closeOnce: make(chan struct{}),
+	}
+	conn := &udpgwPacketConn{flow: flow}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	flow.packets <- []byte("payload")
+
+	n, _, err := conn.ReadFrom(make([]byte, 1500))
+	if err != nil {
+		t.Fatalf("ReadFrom failed: %s", err)
+	}
+	if n != len("payload") {
+		t.Errorf("n = %d, expected %d", n, len("payload"))
+	}
+}
+
+// TestUdpgwPacketConnWriteToRejectsClosedFlow exercises the fix for a
+// previously silent black hole: writing to a closed flow must return an
+// error rather than transparently re-dialing a new channel and sending a
+// data frame the server has never registered a connId for.
+func TestUdpgwPacketConnWriteToRejectsClosedFlow(t *testing.T) {
+	flow := &udpgwFlow{closeOnce: make(chan struct{})}
+	flow.close()
+	conn := &udpgwPacketConn{tunnel: &Tunnel{}, flow: flow}
+
+	_, err := conn.WriteTo([]byte("payload"), nil)
+	if err == nil {
+		t.Errorf("expected an error writing to a closed flow")
+	}
+}
+
+// TestUdpgwPacketConnWriteToReregistersOnChannelChange verifies that when
+// the shared udpgw channel has been replaced since a flow last sent data,
+// WriteTo re-sends the udpgwFlagNewConnection registration rather than
+// silently addressing a connId the new channel's server side has never
+// heard of.
+func TestUdpgwPacketConnWriteToReregistersOnChannelChange(t *testing.T) {
+	remoteAddr, err := net.ResolveUDPAddr("udp", "192.0.2.1:53")
+	if err != nil {
+		t.Fatalf("ResolveUDPAddr failed: %s", err)
+	}
+
+	flow := &udpgwFlow{
+		connId:     7,
+		remoteAddr: remoteAddr,
+		closeOnce:  make(chan struct{}),
+	}
+
+	firstClient, firstServer := net.Pipe()
+	defer firstClient.Close()
+	defer firstServer.Close()
+
+	tunnel := &Tunnel{udpgwChannel: firstClient}
+	conn := &udpgwPacketConn{tunnel: tunnel, flow: flow}
+
+	go func() {
+		conn.WriteTo([]byte("first"), nil)
+	}()
+	flags, _, _, err := readUdpgwFrame(firstServer)
+	if err != nil {
+		t.Fatalf("readUdpgwFrame failed: %s", err)
+	}
+	if flags&udpgwFlagNewConnection == 0 {
+		t.Errorf("expected the first write on a new channel to register the flow")
+	}
+
+	go func() {
+		conn.WriteTo([]byte("second"), nil)
+	}()
+	flags, _, _, err = readUdpgwFrame(firstServer)
+	if err != nil {
+		t.Fatalf("readUdpgwFrame failed: %s", err)
+	}
+	if flags&udpgwFlagNewConnection != 0 {
+		t.Errorf("expected a second write on the same channel not to re-register")
+	}
+
+	secondClient, secondServer := net.Pipe()
+	defer secondClient.Close()
+	defer secondServer.Close()
+	tunnel.udpgwMutex.Lock()
+	tunnel.udpgwChannel = secondClient
+	tunnel.udpgwMutex.Unlock()
+
+	go func() {
+		conn.WriteTo([]byte("third"), nil)
+	}()
+	flags, _, _, err = readUdpgwFrame(secondServer)
+	if err != nil {
+		t.Fatalf("readUdpgwFrame failed: %s", err)
+	}
+	if flags&udpgwFlagNewConnection == 0 {
+		t.Errorf("expected a write after the channel was replaced to re-register")
+	}
+}
@@ -0,0 +1,105 @@
+// sockFprog's padding below assumes an 8-byte-aligned pointer, so this file
+// is restricted to Linux on amd64 and arm64; see bpf_other.go for other platforms.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/SuppSandroB/psiphon-tunnel-core/psiphon"
+)
+
+// sockFilter mirrors the kernel's struct sock_filter (linux/filter.h).
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+// sockFprog mirrors the kernel's struct sock_fprog, as expected by
+// SO_ATTACH_FILTER. The 6 bytes of padding match the compiler's alignment
+// of the trailing pointer on amd64/arm64.
+type sockFprog struct {
+	len    uint16
+	_      [6]byte
+	filter *sockFilter
+}
+
+// namedBPFPrograms holds the small, fixed set of early-drop filters an
+// operator may select, by name, in a ListenerConfig. Each is a minimal
+// classic BPF program run against the socket's incoming segments.
+var namedBPFPrograms = map[string][]sockFilter{
+	// "accept-all" is a no-op filter, useful for exercising the attach path
+	// itself without dropping any traffic.
+	"accept-all": {
+		{code: 0x06, jt: 0, jf: 0, k: 0xffffffff}, // BPF_RET | BPF_K: return -1 (accept whole packet)
+	},
+}
+
+// attachBPFProgram installs the named cBPF program on listener's underlying
+// socket via SO_ATTACH_FILTER, for early-drop of obvious scanners before
+// their connections reach the protocol and SSH handshake code.
+func attachBPFProgram(listener net.Listener, programName string) error {
+
+	program, ok := namedBPFPrograms[programName]
+	if !ok {
+		return psiphon.ContextError(errors.New("unknown BPF program: " + programName))
+	}
+
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		return psiphon.ContextError(errors.New("BPF filters require a TCP listener"))
+	}
+
+	file, err := tcpListener.File()
+	if err != nil {
+		return psiphon.ContextError(err)
+	}
+	defer file.Close()
+
+	fprog := sockFprog{
+		len:    uint16(len(program)),
+		filter: &program[0],
+	}
+
+	_, _, errno := syscall.Syscall6(
+		syscall.SYS_SETSOCKOPT,
+		file.Fd(),
+		syscall.SOL_SOCKET,
+		syscall.SO_ATTACH_FILTER,
+		uintptr(unsafe.Pointer(&fprog)),
+		unsafe.Sizeof(fprog),
+		0)
+	if errno != 0 {
+		return psiphon.ContextError(errno)
+	}
+
+	return nil
+}
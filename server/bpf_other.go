@@ -0,0 +1,36 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"errors"
+	"net"
+
+	"github.com/SuppSandroB/psiphon-tunnel-core/psiphon"
+)
+
+// attachBPFProgram is only implemented for Linux on amd64 and arm64 (see bpf_linux.go),
+// where SO_ATTACH_FILTER is available and the sock_fprog layout is known.
+func attachBPFProgram(listener net.Listener, programName string) error {
+	return psiphon.ContextError(errors.New("BPF filters are not supported on this platform"))
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SuppSandroB/psiphon-tunnel-core/psiphon"
+)
+
+// meekMaxRequestBodySize caps the bytes read from a single meek HTTP
+// request body, matching the frame size cap used elsewhere (see udpgw.go).
+const meekMaxRequestBodySize = 0xffff
+
+// meekLongPollTimeout is how long a meek request blocks waiting for
+// outbound bytes to relay in its response before replying empty.
+const meekLongPollTimeout = 20 * time.Second
+
+// meekSession is a net.Conn backed by a sequence of HTTP request/response
+// bodies: bytes written by the session's obfuscation/SSH layers are
+// buffered until the next request for this session arrives and flushed as
+// that request's response body, and bytes arriving in a request's body are
+// queued for Read. This lets handleConn drive a meek session exactly as it
+// does a directly accepted TCP conn.
+type meekSession struct {
+	inbox chan []byte
+
+	outboxMutex sync.Mutex
+	outbox      []byte
+	outboxReady chan struct{}
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	readBuffer []byte
+}
+
+func newMeekSession() *meekSession {
+	return &meekSession{
+		inbox:       make(chan []byte, 32),
+		outboxReady: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+}
+
+func (session *meekSession) Read(buffer []byte) (int, error) {
+	for len(session.readBuffer) == 0 {
+		select {
+		case chunk, ok := <-session.inbox:
+			if !ok {
+				return 0, io.EOF
+			}
+			session.readBuffer = chunk
+		case <-session.closed:
+			return 0, io.EOF
+		}
+	}
+	n := copy(buffer, session.readBuffer)
+	session.readBuffer = session.readBuffer[n:]
+	return n, nil
+}
+
+func (session *meekSession) Write(buffer []byte) (int, error) {
+	session.outboxMutex.Lock()
+	session.outbox = append(session.outbox, buffer...)
+	session.outboxMutex.Unlock()
+	select {
+	case session.outboxReady <- struct{}{}:
+	default:
+	}
+	return len(buffer), nil
+}
+
+func (session *meekSession) Close() error {
+	session.closeOnce.Do(func() { close(session.closed) })
+	return nil
+}
+
+func (session *meekSession) LocalAddr() net.Addr                { return meekAddr{} }
+func (session *meekSession) RemoteAddr() net.Addr               { return meekAddr{} }
+func (session *meekSession) SetDeadline(t time.Time) error      { return nil }
+func (session *meekSession) SetReadDeadline(t time.Time) error  { return nil }
+func (session *meekSession) SetWriteDeadline(t time.Time) error { return nil }
+
+var _ net.Conn = (*meekSession)(nil)
+
+type meekAddr struct{}
+
+func (meekAddr) Network() string { return "meek" }
+func (meekAddr) String() string  { return "meek" }
+
+// takeOutbox removes and returns any bytes buffered by Write since the last
+// call, waiting up to timeout for at least one byte to arrive if the outbox
+// is currently empty, in the manner of a meek long-poll response.
+func (session *meekSession) takeOutbox(timeout time.Duration) []byte {
+	if outbox := session.drainOutbox(); len(outbox) > 0 {
+		return outbox
+	}
+
+	select {
+	case <-session.outboxReady:
+	case <-time.After(timeout):
+	case <-session.closed:
+	}
+
+	return session.drainOutbox()
+}
+
+func (session *meekSession) drainOutbox() []byte {
+	session.outboxMutex.Lock()
+	defer session.outboxMutex.Unlock()
+	outbox := session.outbox
+	session.outbox = nil
+	return outbox
+}
+
+// meekServer terminates the HTTP long-poll requests that carry the meek
+// protocols' NaCl-box encrypted cookie (see psiphon.makeMeekCookie),
+// relaying each session's bytes to and from a meekSession that's handed to
+// TunnelServer.handleConn exactly like a directly accepted TCP conn.
+type meekServer struct {
+	server      *TunnelServer
+	protocol    string
+	useFronting bool
+
+	sessionsMutex sync.Mutex
+	sessions      map[string]*meekSession
+}
+
+func newMeekServer(server *TunnelServer, protocol string, useFronting bool) *meekServer {
+	return &meekServer{
+		server:      server,
+		protocol:    protocol,
+		useFronting: useFronting,
+		sessions:    make(map[string]*meekSession),
+	}
+}
+
+func (meek *meekServer) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	cookie, err := request.Cookie(psiphon.MEEK_COOKIE_NAME)
+	if err != nil {
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return
+	}
+
+	_, sessionId, err := psiphon.UnpackMeekCookie(
+		meek.server.support.MeekCookieEncryptionPrivateKey,
+		meek.server.support.SshObfuscatedKey,
+		meek.useFronting,
+		cookie.Value)
+	if err != nil {
+		psiphon.Notice(psiphon.NOTICE_ALERT, "invalid meek cookie from %s: %s", request.RemoteAddr, err)
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return
+	}
+
+	session, isNew := meek.getOrCreateSession(sessionId)
+	if isNew {
+		clientIP := clientIPFromAddr(request.RemoteAddr)
+		if !meek.server.acceptClientConn(clientIP) {
+			psiphon.Notice(psiphon.NOTICE_ALERT, "rejecting meek session from %s: rate limit exceeded", clientIP)
+			meek.removeSession(sessionId)
+			http.Error(responseWriter, "", http.StatusTooManyRequests)
+			return
+		}
+		go func() {
+			meek.server.handleConn(meek.protocol, session, clientIP)
+			meek.removeSession(sessionId)
+		}()
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, meekMaxRequestBodySize))
+	if err != nil {
+		http.Error(responseWriter, "", http.StatusBadRequest)
+		return
+	}
+	if len(body) > 0 {
+		select {
+		case session.inbox <- body:
+		case <-session.closed:
+			http.Error(responseWriter, "", http.StatusGone)
+			return
+		}
+	}
+
+	responseWriter.Write(session.takeOutbox(meekLongPollTimeout))
+}
+
+func (meek *meekServer) getOrCreateSession(sessionId string) (session *meekSession, isNew bool) {
+	meek.sessionsMutex.Lock()
+	defer meek.sessionsMutex.Unlock()
+	if session, ok := meek.sessions[sessionId]; ok {
+		return session, false
+	}
+	session = newMeekSession()
+	meek.sessions[sessionId] = session
+	return session, true
+}
+
+func (meek *meekServer) removeSession(sessionId string) {
+	meek.sessionsMutex.Lock()
+	defer meek.sessionsMutex.Unlock()
+	if session, ok := meek.sessions[sessionId]; ok {
+		session.Close()
+		delete(meek.sessions, sessionId)
+	}
+}
+
+// runMeekListener serves HTTP requests on listener, terminating the meek
+// protocol identified by protocol and relaying each session's bytes into
+// handleConn, until shutdownBroadcast is closed.
+func (server *TunnelServer) runMeekListener(protocol string, listener net.Listener, waitGroup *sync.WaitGroup) {
+	defer waitGroup.Done()
+	defer listener.Close()
+
+	go func() {
+		<-server.shutdownBroadcast
+		listener.Close()
+	}()
+
+	meek := newMeekServer(server, protocol, protocol == psiphon.TUNNEL_PROTOCOL_FRONTED_MEEK)
+	httpServer := &http.Server{Handler: meek}
+
+	err := httpServer.Serve(listener)
+	if err != nil {
+		select {
+		case <-server.shutdownBroadcast:
+		default:
+			psiphon.Notice(psiphon.NOTICE_ALERT, "meek listener for %s failed: %s", protocol, err)
+		}
+	}
+}
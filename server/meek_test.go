@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMeekSessionReadDeliversInboxChunks(t *testing.T) {
+	session := newMeekSession()
+	session.inbox <- []byte("hello")
+
+	buffer := make([]byte, 3)
+	n, err := session.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if string(buffer[:n]) != "hel" {
+		t.Errorf("Read = %q, expected %q", buffer[:n], "hel")
+	}
+
+	n, err = session.Read(buffer)
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if string(buffer[:n]) != "lo" {
+		t.Errorf("Read = %q, expected %q", buffer[:n], "lo")
+	}
+}
+
+func TestMeekSessionReadReturnsEOFAfterClose(t *testing.T) {
+	session := newMeekSession()
+	session.Close()
+
+	_, err := session.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("Read err = %v, expected io.EOF", err)
+	}
+}
+
+func TestMeekSessionTakeOutboxReturnsWrittenBytes(t *testing.T) {
+	session := newMeekSession()
+
+	if _, err := session.Write([]byte("foo")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+	if _, err := session.Write([]byte("bar")); err != nil {
+		t.Fatalf("Write failed: %s", err)
+	}
+
+	outbox := session.takeOutbox(time.Second)
+	if string(outbox) != "foobar" {
+		t.Errorf("takeOutbox = %q, expected %q", outbox, "foobar")
+	}
+}
+
+func TestMeekSessionTakeOutboxTimesOutWhenEmpty(t *testing.T) {
+	session := newMeekSession()
+
+	start := time.Now()
+	outbox := session.takeOutbox(20 * time.Millisecond)
+	if len(outbox) != 0 {
+		t.Errorf("expected an empty outbox, got %q", outbox)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Errorf("expected takeOutbox to wait for the full timeout")
+	}
+}
+
+func TestMeekSessionTakeOutboxReturnsEarlyOnClose(t *testing.T) {
+	session := newMeekSession()
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		session.Close()
+	}()
+
+	start := time.Now()
+	session.takeOutbox(time.Minute)
+	if time.Since(start) >= time.Minute {
+		t.Errorf("expected takeOutbox to return early once the session was closed")
+	}
+}
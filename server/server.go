@@ -0,0 +1,296 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package server implements the server side of a Psiphon tunnel: a listener
+// stack matching the protocols a client may dial, terminating into an SSH
+// server session, so that the full client/server handshake can be exercised
+// in integration tests without a separate deployment.
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+
+	"code.google.com/p/go.crypto/ssh"
+
+	"github.com/SuppSandroB/psiphon-tunnel-core/psiphon"
+)
+
+var errAuthenticationFailed = errors.New("authentication failed")
+
+// ListenerConfig specifies a single protocol listener: the address to
+// listen on and, optionally, a cBPF program to attach to the listening
+// socket for early-drop of obvious scanners.
+type ListenerConfig struct {
+	ListenAddress  string
+	BPFProgramName string
+}
+
+// SupportServices bundles the configuration and shared state a TunnelServer
+// needs to accept and authenticate tunnels: which protocols to listen for
+// and on what addresses, the SSH host key and credentials clients are
+// expected to present, the meek cookie decryption key, and a rate limit on
+// accepted connections per client IP.
+type SupportServices struct {
+	Listeners                      map[string]*ListenerConfig // protocol -> listener config
+	SshHostKey                     []byte                     // PEM-encoded private key
+	SshUsername                    string
+	SshPassword                    string
+	SshObfuscatedKey               string    // matches the client's serverEntry.SshObfuscatedKey
+	MeekCookieEncryptionPrivateKey *[32]byte // matches the client's serverEntry.MeekCookieEncryptionPublicKey
+	MaxAcceptedConnsPerClient      int
+}
+
+// TunnelServer listens on the protocols enumerated in
+// psiphon.SupportedTunnelProtocols that support has a ListenerConfig for,
+// and terminates each accepted connection into an ssh.ServerConn.
+type TunnelServer struct {
+	support           *SupportServices
+	shutdownBroadcast <-chan struct{}
+	sshServerConfig   *ssh.ServerConfig
+
+	clientCountsMutex sync.Mutex
+	clientCounts      map[string]int
+}
+
+// NewTunnelServer creates a TunnelServer. shutdownBroadcast is closed by the
+// caller to signal all listeners and accepted connections to stop.
+func NewTunnelServer(
+	support *SupportServices, shutdownBroadcast <-chan struct{}) (*TunnelServer, error) {
+
+	hostKeySigner, err := ssh.ParsePrivateKey(support.SshHostKey)
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	sshServerConfig := &ssh.ServerConfig{
+		PasswordCallback: func(
+			connMeta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return authenticateSshPassword(support, connMeta, password)
+		},
+	}
+	sshServerConfig.AddHostKey(hostKeySigner)
+
+	return &TunnelServer{
+		support:           support,
+		shutdownBroadcast: shutdownBroadcast,
+		sshServerConfig:   sshServerConfig,
+		clientCounts:      make(map[string]int),
+	}, nil
+}
+
+// authenticateSshPassword validates the JSON {SessionId, SshPassword}
+// payload produced by psiphon.EstablishTunnel as the SSH password, checking
+// both that it parses and that the username/password match configured
+// values.
+func authenticateSshPassword(
+	support *SupportServices, connMeta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+
+	var payload struct {
+		SessionId   string `json:"SessionId"`
+		SshPassword string `json:"SshPassword"`
+	}
+	err := json.Unmarshal(password, &payload)
+	if err != nil {
+		return nil, psiphon.ContextError(err)
+	}
+
+	if connMeta.User() != support.SshUsername || payload.SshPassword != support.SshPassword {
+		return nil, psiphon.ContextError(errAuthenticationFailed)
+	}
+
+	return &ssh.Permissions{
+		Extensions: map[string]string{"sessionId": payload.SessionId},
+	}, nil
+}
+
+// Run starts a listener for each protocol in psiphon.SupportedTunnelProtocols
+// that has a configured ListenerConfig, and blocks, accepting and servicing
+// connections, until shutdownBroadcast is closed.
+func (server *TunnelServer) Run() error {
+
+	var waitGroup sync.WaitGroup
+	var listeners []net.Listener
+
+	closeListeners := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+
+	for _, protocol := range psiphon.SupportedTunnelProtocols {
+		listenerConfig, ok := server.support.Listeners[protocol]
+		if !ok {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", listenerConfig.ListenAddress)
+		if err != nil {
+			closeListeners()
+			return psiphon.ContextError(err)
+		}
+		listeners = append(listeners, listener)
+
+		if listenerConfig.BPFProgramName != "" {
+			err := attachBPFProgram(listener, listenerConfig.BPFProgramName)
+			if err != nil {
+				closeListeners()
+				return psiphon.ContextError(err)
+			}
+		}
+
+		psiphon.Notice(psiphon.NOTICE_INFO, "listening for %s on %s", protocol, listenerConfig.ListenAddress)
+
+		waitGroup.Add(1)
+		if isMeekProtocol(protocol) {
+			go server.runMeekListener(protocol, listener, &waitGroup)
+		} else {
+			go server.runListener(protocol, listener, &waitGroup)
+		}
+	}
+
+	<-server.shutdownBroadcast
+	waitGroup.Wait()
+
+	return nil
+}
+
+// runListener accepts connections on listener, applying the per-client
+// accepted-connection rate limit, until shutdownBroadcast is closed.
+func (server *TunnelServer) runListener(protocol string, listener net.Listener, waitGroup *sync.WaitGroup) {
+	defer waitGroup.Done()
+	defer listener.Close()
+
+	go func() {
+		<-server.shutdownBroadcast
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			// The listener is closed either because shutdownBroadcast fired or
+			// because Run is unwinding after a later listener failed to start;
+			// either way, Accept will never succeed again on this listener.
+			select {
+			case <-server.shutdownBroadcast:
+			default:
+				psiphon.Notice(psiphon.NOTICE_ALERT, "accept for %s failed: %s", protocol, err)
+			}
+			return
+		}
+
+		clientIP := clientIPAddress(conn)
+		if !server.acceptClientConn(clientIP) {
+			psiphon.Notice(psiphon.NOTICE_ALERT, "rejecting connection from %s: rate limit exceeded", clientIP)
+			conn.Close()
+			continue
+		}
+
+		go server.handleConn(protocol, conn, clientIP)
+	}
+}
+
+// handleConn layers obfuscation, matching the protocol, on top of conn and
+// then completes the SSH server handshake. For the meek protocols, conn is
+// a meekSession (see meek.go) rather than a directly accepted TCP conn; the
+// meek HTTP termination has already happened by the time handleConn runs.
+func (server *TunnelServer) handleConn(protocol string, conn net.Conn, clientIP string) {
+	defer server.releaseClientConn(clientIP)
+	defer conn.Close()
+
+	handleDone := make(chan struct{})
+	defer close(handleDone)
+	go func() {
+		select {
+		case <-server.shutdownBroadcast:
+			conn.Close()
+		case <-handleDone:
+		}
+	}()
+
+	sshConn := conn
+	if strings.HasSuffix(protocol, "-OSSH") || protocol == psiphon.TUNNEL_PROTOCOL_OBFUSCATED_SSH {
+		obfuscatedConn, err := psiphon.NewObfuscatedSshConn(conn, server.support.SshObfuscatedKey)
+		if err != nil {
+			psiphon.Notice(psiphon.NOTICE_ALERT, "obfuscation failed: %s", err)
+			return
+		}
+		sshConn = obfuscatedConn
+	}
+
+	_, newChannels, requests, err := ssh.NewServerConn(sshConn, server.sshServerConfig)
+	if err != nil {
+		psiphon.Notice(psiphon.NOTICE_ALERT, "ssh handshake with %s failed: %s", clientIP, err)
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+	for newChannel := range newChannels {
+		newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+	}
+}
+
+// acceptClientConn increments and checks clientIP's accepted connection
+// count against MaxAcceptedConnsPerClient, returning false when the limit
+// has been reached.
+func (server *TunnelServer) acceptClientConn(clientIP string) bool {
+	server.clientCountsMutex.Lock()
+	defer server.clientCountsMutex.Unlock()
+
+	limit := server.support.MaxAcceptedConnsPerClient
+	if limit > 0 && server.clientCounts[clientIP] >= limit {
+		return false
+	}
+	server.clientCounts[clientIP]++
+	return true
+}
+
+func (server *TunnelServer) releaseClientConn(clientIP string) {
+	server.clientCountsMutex.Lock()
+	defer server.clientCountsMutex.Unlock()
+
+	server.clientCounts[clientIP]--
+	if server.clientCounts[clientIP] <= 0 {
+		delete(server.clientCounts, clientIP)
+	}
+}
+
+func clientIPAddress(conn net.Conn) string {
+	return clientIPFromAddr(conn.RemoteAddr().String())
+}
+
+func clientIPFromAddr(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// isMeekProtocol returns true for the protocols that need HTTP termination
+// (see meek.go) ahead of the obfuscation/SSH layering handleConn performs,
+// rather than being handed a directly accepted TCP conn.
+func isMeekProtocol(protocol string) bool {
+	return protocol == psiphon.TUNNEL_PROTOCOL_UNFRONTED_MEEK ||
+		protocol == psiphon.TUNNEL_PROTOCOL_FRONTED_MEEK
+}
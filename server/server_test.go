@@ -0,0 +1,141 @@
+/*
+ * Copyright (c) 2014, Psiphon Inc.
+ * All rights reserved.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"code.google.com/p/go.crypto/ssh"
+
+	"github.com/SuppSandroB/psiphon-tunnel-core/psiphon"
+)
+
+func TestClientIPFromAddr(t *testing.T) {
+	ip := clientIPFromAddr("192.0.2.1:12345")
+	if ip != "192.0.2.1" {
+		t.Errorf("clientIPFromAddr = %q, expected %q", ip, "192.0.2.1")
+	}
+}
+
+func TestClientIPFromAddrWithoutPort(t *testing.T) {
+	ip := clientIPFromAddr("not-a-host-port")
+	if ip != "not-a-host-port" {
+		t.Errorf("clientIPFromAddr = %q, expected the input unchanged", ip)
+	}
+}
+
+func TestIsMeekProtocol(t *testing.T) {
+	if !isMeekProtocol(psiphon.TUNNEL_PROTOCOL_UNFRONTED_MEEK) {
+		t.Errorf("expected %s to be a meek protocol", psiphon.TUNNEL_PROTOCOL_UNFRONTED_MEEK)
+	}
+	if !isMeekProtocol(psiphon.TUNNEL_PROTOCOL_FRONTED_MEEK) {
+		t.Errorf("expected %s to be a meek protocol", psiphon.TUNNEL_PROTOCOL_FRONTED_MEEK)
+	}
+	if isMeekProtocol(psiphon.TUNNEL_PROTOCOL_OBFUSCATED_SSH) {
+		t.Errorf("expected %s not to be a meek protocol", psiphon.TUNNEL_PROTOCOL_OBFUSCATED_SSH)
+	}
+}
+
+func TestAcceptClientConnEnforcesLimit(t *testing.T) {
+	server := &TunnelServer{
+		support:      &SupportServices{MaxAcceptedConnsPerClient: 2},
+		clientCounts: make(map[string]int),
+	}
+
+	if !server.acceptClientConn("192.0.2.1") {
+		t.Fatalf("expected the first connection to be accepted")
+	}
+	if !server.acceptClientConn("192.0.2.1") {
+		t.Fatalf("expected the second connection to be accepted")
+	}
+	if server.acceptClientConn("192.0.2.1") {
+		t.Errorf("expected a third connection to be rejected once the limit is reached")
+	}
+
+	server.releaseClientConn("192.0.2.1")
+	if !server.acceptClientConn("192.0.2.1") {
+		t.Errorf("expected a connection to be accepted again after one was released")
+	}
+}
+
+func TestAcceptClientConnUnlimitedWhenZero(t *testing.T) {
+	server := &TunnelServer{
+		support:      &SupportServices{MaxAcceptedConnsPerClient: 0},
+		clientCounts: make(map[string]int),
+	}
+
+	for i := 0; i < 10; i++ {
+		if !server.acceptClientConn("192.0.2.1") {
+			t.Fatalf("expected no limit to be enforced when MaxAcceptedConnsPerClient is 0")
+		}
+	}
+}
+
+func TestAuthenticateSshPassword(t *testing.T) {
+	support := &SupportServices{SshUsername: "psiphon", SshPassword: "secret"}
+
+	payload, err := json.Marshal(struct {
+		SessionId   string `json:"SessionId"`
+		SshPassword string `json:"SshPassword"`
+	}{"session-1", "secret"})
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+
+	permissions, err := authenticateSshPassword(support, fakeConnMetadata{user: "psiphon"}, payload)
+	if err != nil {
+		t.Fatalf("authenticateSshPassword failed: %s", err)
+	}
+	if permissions.Extensions["sessionId"] != "session-1" {
+		t.Errorf("sessionId extension = %q, expected %q", permissions.Extensions["sessionId"], "session-1")
+	}
+}
+
+func TestAuthenticateSshPasswordRejectsWrongPassword(t *testing.T) {
+	support := &SupportServices{SshUsername: "psiphon", SshPassword: "secret"}
+
+	payload, err := json.Marshal(struct {
+		SessionId   string `json:"SessionId"`
+		SshPassword string `json:"SshPassword"`
+	}{"session-1", "wrong"})
+	if err != nil {
+		t.Fatalf("json.Marshal failed: %s", err)
+	}
+
+	_, err = authenticateSshPassword(support, fakeConnMetadata{user: "psiphon"}, payload)
+	if err == nil {
+		t.Errorf("expected an error for a mismatched password")
+	}
+}
+
+type fakeConnMetadata struct {
+	user string
+}
+
+func (m fakeConnMetadata) User() string          { return m.user }
+func (m fakeConnMetadata) SessionID() []byte     { return nil }
+func (m fakeConnMetadata) ClientVersion() []byte { return nil }
+func (m fakeConnMetadata) ServerVersion() []byte { return nil }
+func (m fakeConnMetadata) RemoteAddr() net.Addr  { return nil }
+func (m fakeConnMetadata) LocalAddr() net.Addr   { return nil }
+
+var _ ssh.ConnMetadata = fakeConnMetadata{}